@@ -2,31 +2,119 @@ package fluent
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/lafikl/backoff"
+	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
-	"errors"
 	"io"
 )
 
+// errRetriable is an internal signal meaning "doReq wants another
+// attempt"; it never reaches the caller. The actual reason (the last
+// transport error or response) is always recorded in f.err so do() can
+// surface that instead, however the retry loop ends.
+var errRetriable = errors.New("fluent: retriable response or error")
+
+// multipartPart is either a plain form field (value set) or a file part
+// (fileName and one of reader/path set). buf/buffered cache a reader
+// part's bytes after the first attempt so retries can resend them.
+type multipartPart struct {
+	field    string
+	fileName string
+	value    string
+	reader   io.Reader
+	path     string
+	buf      []byte
+	buffered bool
+}
+
 type request struct {
-	header    map[string]string
-	method    string
-	json      interface{}
-	jsonIsSet bool
-	url       string
-	retry     int
-	timeout   time.Duration
-	body      io.Reader
-	res       *http.Response
-	err       error
-	backoff   *backoff.ExponentialBackOff
+	header      map[string]string
+	method      string
+	json        interface{}
+	jsonIsSet   bool
+	multipart      []multipartPart
+	multipartIsSet bool
+	formValues  url.Values
+	formIsSet   bool
+	url         string
+	retry       int
+	retryUnsafe bool
+	retryPolicy func(*http.Response, error) bool
+	retryAfter  time.Duration
+	timeout     time.Duration
+	body        io.Reader
+	bodyBuf     *bytes.Reader
+	maxBufferedBody int64
+	expectStatuses    []int
+	expectStatusIsSet bool
+	baseURL     string
+	httpClient  *http.Client
+	transport   http.RoundTripper
+	res         *http.Response
+	err         error
+	backoff     *backoff.ExponentialBackOff
 	req 			*http.Request
+	ctx         context.Context
+	unsafeToRetry bool
+	retried       bool
+}
+
+// Client lets you share an *http.Client (and its connection pool), a
+// base URL, and a set of default headers across many requests, instead
+// of paying for a brand-new http.Client on every New().
+type Client struct {
+	BaseURL        string
+	DefaultHeaders map[string]string
+	HTTPClient     *http.Client
+	DefaultBackoff *backoff.ExponentialBackOff
+}
+
+// New creates a request pre-configured with c's BaseURL, DefaultHeaders,
+// HTTPClient and DefaultBackoff. Url("/path") on the returned request
+// resolves against BaseURL.
+func (c *Client) New() *request {
+	f := New()
+	f.baseURL = c.BaseURL
+	if c.HTTPClient != nil {
+		f.httpClient = c.HTTPClient
+	}
+	if c.DefaultBackoff != nil {
+		bo := *c.DefaultBackoff
+		f.backoff = &bo
+	}
+	for k, v := range c.DefaultHeaders {
+		f.SetHeader(k, v)
+	}
+	return f
 }
 
 func (f *request) newClient() *http.Client {
-	return &http.Client{Timeout: f.timeout}
+	base := f.httpClient
+	if base == nil {
+		base = &http.Client{}
+	}
+	if f.timeout == 0 && f.transport == nil {
+		return base
+	}
+	c := *base
+	if f.timeout != 0 {
+		c.Timeout = f.timeout
+	}
+	if f.transport != nil {
+		c.Transport = f.transport
+	}
+	return &c
 }
 
 func (f *request) newRequest() (*http.Request, error) {
@@ -37,22 +125,202 @@ func (f *request) newRequest() (*http.Request, error) {
 		if jsonErr != nil {
 			return nil, jsonErr
 		}
-		req, err = http.NewRequest(f.method, f.url, bytes.NewReader(body))
+		req, err = http.NewRequestWithContext(f.ctx, f.method, f.url, bytes.NewReader(body))
+	} else if f.multipartIsSet {
+		body, contentType, mpErr := f.buildMultipart()
+		if mpErr != nil {
+			return nil, mpErr
+		}
+		req, err = http.NewRequestWithContext(f.ctx, f.method, f.url, body)
+		if err == nil {
+			req.Header.Set("Content-Type", contentType)
+		}
+	} else if f.formIsSet {
+		req, err = http.NewRequestWithContext(f.ctx, f.method, f.url, strings.NewReader(f.formValues.Encode()))
 	} else if f.body != nil {
-		req, err = http.NewRequest(f.method, f.url, f.body)
+		body, getBody, bodyErr := f.rewindableBody()
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		req, err = http.NewRequestWithContext(f.ctx, f.method, f.url, body)
+		if err == nil && getBody != nil {
+			req.GetBody = getBody
+		}
 	} else {
-		req, err = http.NewRequest(f.method, f.url, nil)
+		req, err = http.NewRequestWithContext(f.ctx, f.method, f.url, nil)
 	}
 	return req, err
 }
 
+// defaultMaxBufferedBody is how much of a non-seekable body we'll buffer
+// in memory so it can be replayed on retry, unless MaxBufferedBody says
+// otherwise.
+const defaultMaxBufferedBody = 10 << 20 // 10MB
+
+// rewindableBody returns a reader for f.body that can be read again on a
+// retry, along with the req.GetBody func (see net/http) that does it.
+//
+// Seekable readers (e.g. os.File) are rewound in place. Everything else
+// is buffered once, up to MaxBufferedBody; past that limit we give up on
+// retry-safety for this body, stream the original reader for this one
+// attempt, and set f.unsafeToRetry so doReq won't retry into a drained,
+// truncated resend of it.
+func (f *request) rewindableBody() (io.Reader, func() (io.ReadCloser, error), error) {
+	if seeker, ok := f.body.(io.Seeker); ok {
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, nil, err
+		}
+		getBody := func() (io.ReadCloser, error) {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(f.body), nil
+		}
+		return f.body, getBody, nil
+	}
+
+	if f.bodyBuf == nil {
+		limit := f.maxBufferedBody
+		if limit <= 0 {
+			limit = defaultMaxBufferedBody
+		}
+		buffered, err := ioutil.ReadAll(io.LimitReader(f.body, limit+1))
+		if err != nil {
+			return nil, nil, err
+		}
+		if int64(len(buffered)) > limit {
+			// Too big to buffer for retries. We still stream the full
+			// body (the already-consumed prefix plus whatever's left of
+			// f.body) so this first attempt goes out intact, but f.body
+			// is now drained: a second call here would read nothing. Mark
+			// the request retry-unsafe so doReq never attempts a retry
+			// that would silently resend a truncated/empty body.
+			f.unsafeToRetry = true
+			return io.MultiReader(bytes.NewReader(buffered), f.body), nil, nil
+		}
+		f.bodyBuf = bytes.NewReader(buffered)
+	} else {
+		f.bodyBuf.Seek(0, io.SeekStart)
+	}
+
+	buf := f.bodyBuf
+	getBody := func() (io.ReadCloser, error) {
+		buf.Seek(0, io.SeekStart)
+		return ioutil.NopCloser(buf), nil
+	}
+	return buf, getBody, nil
+}
+
+// buildMultipart renders the accumulated MultipartField/MultipartFile/
+// MultipartFromPath parts into a multipart/form-data body, returning the
+// body along with the Content-Type header (including boundary) it needs.
+//
+// It's called again from newRequest on every retry attempt, so a
+// MultipartFile reader is buffered the first time it's read (like
+// rewindableBody does for Body) rather than drained once and sent empty
+// on the retry; MultipartFromPath instead just reopens the file by path.
+func (f *request) buildMultipart() (io.Reader, string, error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for i := range f.multipart {
+		p := &f.multipart[i]
+		if p.reader == nil && p.path == "" {
+			if err := w.WriteField(p.field, p.value); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		fw, err := w.CreateFormFile(p.field, p.fileName)
+		if err != nil {
+			return nil, "", err
+		}
+		r, err := f.multipartFileReader(p)
+		if err != nil {
+			return nil, "", err
+		}
+		_, copyErr := io.Copy(fw, r)
+		r.Close()
+		if copyErr != nil {
+			return nil, "", copyErr
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buf, w.FormDataContentType(), nil
+}
+
+// multipartFileReader returns a reader for a file part, rebuilt fresh
+// on every call so retries see the same bytes: a path-based part is
+// reopened, and a reader-based part is buffered on first use (up to
+// MaxBufferedBody) and served from that buffer afterwards. A part
+// bigger than MaxBufferedBody is sent in full on this attempt, but it
+// also marks the request unsafe to retry, same as rewindableBody.
+func (f *request) multipartFileReader(p *multipartPart) (io.ReadCloser, error) {
+	if p.path != "" {
+		return os.Open(p.path)
+	}
+	if p.buffered {
+		return ioutil.NopCloser(bytes.NewReader(p.buf)), nil
+	}
+	limit := f.maxBufferedBody
+	if limit <= 0 {
+		limit = defaultMaxBufferedBody
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(p.reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		// Too big to buffer for retries; same situation as the oversized
+		// branch in rewindableBody. This attempt still streams the full
+		// part, but p.reader is now drained, so mark the whole request
+		// retry-unsafe rather than let a retry resend this part empty.
+		f.unsafeToRetry = true
+		return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), p.reader)), nil
+	}
+	p.buf = data
+	p.buffered = true
+	return ioutil.NopCloser(bytes.NewReader(p.buf)), nil
+}
+
+// Context sets the context.Context that governs the request, including
+// any retries. Cancelling ctx (or hitting its deadline) aborts the
+// in-flight HTTP call and any backoff sleep between attempts.
+//
+// This composes with Timeout: Timeout bounds each individual attempt,
+// while ctx bounds the request as a whole.
+func (f *request) Context(ctx context.Context) *request {
+	f.ctx = ctx
+	return f
+}
+
 // Set the request URL
 // You probably want to use the methods [Post, Get, Patch, Delete, Put]
+//
+// If this request was created from a Client with a BaseURL, a relative
+// url is resolved against it, e.g. "/users" against "https://api.test"
+// becomes "https://api.test/users".
 func (f *request) Url(url string) *request {
-	f.url = url
+	f.url = f.resolveURL(url)
 	return f
 }
 
+func (f *request) resolveURL(path string) string {
+	if f.baseURL == "" {
+		return path
+	}
+	base, err := url.Parse(f.baseURL)
+	if err != nil {
+		return path
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return path
+	}
+	return base.ResolveReference(ref).String()
+}
+
 // Set the request Method
 // You probably want to use the methods [Post, Get, Patch, Delete, Put]
 func (f *request) Method(method string) *request {
@@ -101,9 +369,74 @@ func (f *request) Json(j interface{}) *request {
 	return f
 }
 
-// Whatever you pass to it will be passed to http.NewRequest
+// Form sets an application/x-www-form-urlencoded body, encoded from
+// values. This overrides whatever you pass to f.Body.
+func (f *request) Form(values url.Values) *request {
+	f.formValues = values
+	f.formIsSet = true
+	f.SetHeader("Content-type", "application/x-www-form-urlencoded")
+	return f
+}
+
+// FormField adds a single key/value pair to the form body, creating it
+// if Form hasn't been called yet.
+func (f *request) FormField(key, value string) *request {
+	if f.formValues == nil {
+		f.formValues = url.Values{}
+	}
+	f.formValues.Add(key, value)
+	f.formIsSet = true
+	f.SetHeader("Content-type", "application/x-www-form-urlencoded")
+	return f
+}
+
+// Whatever you pass to it will be passed to http.NewRequest.
+//
+// If r is retried (see Retry), fluent rewinds it when it's an
+// io.Seeker, or otherwise buffers it in memory so the retry sees the
+// same body; see MaxBufferedBody for the buffering limit. Json and
+// Form bodies are always retry-safe, since fluent rebuilds them itself
+// on every attempt.
 func (f *request) Body(b io.Reader) *request {
 	f.body = b
+	f.bodyBuf = nil
+	return f
+}
+
+// MaxBufferedBody caps how much of a non-seekable Body fluent will
+// buffer in memory to make it retry-safe. The default is 10MB; past
+// that, fluent still sends the first attempt in full but disables
+// retrying for this request rather than risk resending a truncated or
+// empty body.
+func (f *request) MaxBufferedBody(n int64) *request {
+	f.maxBufferedBody = n
+	return f
+}
+
+// MultipartField adds a plain form field to a multipart/form-data body.
+// Combine with MultipartFile/MultipartFromPath to build a request like
+// New().Post(url).MultipartFile("file", "a.png", fd).MultipartField("desc", "hi").Send()
+func (f *request) MultipartField(name, value string) *request {
+	f.multipart = append(f.multipart, multipartPart{field: name, value: value})
+	f.multipartIsSet = true
+	return f
+}
+
+// MultipartFile adds a file part to a multipart/form-data body, reading
+// its contents from r. Like Body, r is buffered in memory (up to
+// MaxBufferedBody) the first time it's read, so a retried request
+// resends the same bytes instead of an empty part.
+func (f *request) MultipartFile(fieldName, fileName string, r io.Reader) *request {
+	f.multipart = append(f.multipart, multipartPart{field: fieldName, fileName: fileName, reader: r})
+	f.multipartIsSet = true
+	return f
+}
+
+// MultipartFromPath is like MultipartFile but opens the file at path
+// itself and uses its base name as the file part's file name.
+func (f *request) MultipartFromPath(fieldName, path string) *request {
+	f.multipart = append(f.multipart, multipartPart{field: fieldName, fileName: filepath.Base(path), path: path})
+	f.multipartIsSet = true
 	return f
 }
 
@@ -159,12 +492,90 @@ func (f *request) Clock(c backoff.Clock) *request {
 	return f
 }
 
+// Transport overrides the http.RoundTripper used for this request only,
+// e.g. to inject a mock transport in tests or wrap one with tracing.
+// It takes precedence over the http.Client's own Transport, including
+// one shared via Client.HTTPClient.
+func (f *request) Transport(rt http.RoundTripper) *request {
+	f.transport = rt
+	return f
+}
+
 func (f *request) Retry(r int) *request {
 	f.retry = r
 	return f
 }
 
+// RetryPolicy overrides the default decision of whether a response/error
+// pair is worth retrying. By default fluent retries on transport errors
+// and on 5xx or 429 responses.
+//
+// The policy only decides whether a failure *looks* retriable; it's
+// still subject to the retry count set via Retry and to the
+// idempotency check (see RetryUnsafe).
+func (f *request) RetryPolicy(p func(*http.Response, error) bool) *request {
+	f.retryPolicy = p
+	return f
+}
+
+// RetryUnsafe opts into retrying non-idempotent methods (POST, PATCH).
+// By default fluent never retries those, since resending them can
+// duplicate the effect of the original request.
+func (f *request) RetryUnsafe(unsafe bool) *request {
+	f.retryUnsafe = unsafe
+	return f
+}
+
+func defaultRetryPolicy(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if res == nil {
+		return false
+	}
+	if res.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	return res.StatusCode >= 500 && res.StatusCode <= 599
+}
+
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPatch:
+		return false
+	default:
+		return true
+	}
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which is
+// either a number of seconds or an HTTP-date (see RFC 7231 7.1.3).
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
 func doReq(f *request, c *http.Client) error {
+	if f.res != nil {
+		io.Copy(ioutil.Discard, f.res.Body)
+		f.res.Body.Close()
+		f.res = nil
+	}
+
 	var reqErr error
 	f.req, reqErr = f.newRequest()
 	if reqErr != nil {
@@ -173,20 +584,60 @@ func doReq(f *request, c *http.Client) error {
 	for k, v := range f.header {
 		f.req.Header.Set(k, v)
 	}
+
+	f.retryAfter = 0
 	res, err := c.Do(f.req)
-	// if there's an error in the request
-	// and there's no retries, then we just return whatever err we got
-	if err != nil {
-		f.err = err
-		return nil
+
+	policy := f.retryPolicy
+	if policy == nil {
+		policy = defaultRetryPolicy
 	}
-	if res != nil && res.StatusCode >= 500 && res.StatusCode <= 599 && f.retry > 0 {
+
+	// eligible is "this attempt failed in a way that, in principle, we'd
+	// retry" - as opposed to a response/error we were never going to
+	// retry in the first place (wrong method, unbuffered body, ...).
+	eligible := policy(res, err) && !f.unsafeToRetry && (f.retryUnsafe || isIdempotentMethod(f.method))
+
+	if eligible && f.retry > 0 {
 		f.retry--
-		return errors.New("Server Error")
+		f.retried = true
+		if res != nil {
+			if ra, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				f.retryAfter = ra
+			}
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			f.err = &UnexpectedStatusError{StatusCode: res.StatusCode, Body: body}
+		} else {
+			f.err = err
+		}
+		return errRetriable
 	}
-	if res != nil {
-		f.res = res	
+
+	if eligible && f.retried {
+		// We already spent this request's retry budget, and this last
+		// attempt still failed. Surface it the same way backoff giving
+		// up (MaxElapsedTime) does, instead of quietly returning this
+		// failing response/error as if it were a success.
+		if res != nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			f.err = &UnexpectedStatusError{StatusCode: res.StatusCode, Body: body}
+		} else {
+			f.err = err
+		}
+		return nil
+	}
+
+	// if there's an error in the request and it's not retriable
+	// (or retrying was never attempted for this request), we just
+	// return whatever err we got
+	if err != nil {
+		f.err = err
+		return nil
 	}
+	f.res = res
+	f.err = nil
 	return nil
 }
 
@@ -198,24 +649,140 @@ func (f *request) operation(c *http.Client) func() error {
 
 func (f *request) do(c *http.Client) (*http.Response, error) {
 	err := doReq(f, c)
-	if err != nil {
-			op := f.operation(c)
-			err = backoff.Retry(op, f.backoff)
-			if err != nil {
-				return nil, err
+	if err != nil && err != errRetriable {
+		// a fatal, non-retriable error building the request (e.g. a
+		// Json marshal failure); nothing to retry here.
+		return nil, err
+	}
+	if err == errRetriable {
+		f.backoff.Reset()
+		op := f.operation(c)
+		for {
+			next := f.retryAfter
+			if next == 0 {
+				next = f.backoff.NextBackOff()
+				if next == backoff.Stop {
+					break
+				}
+			}
+			timer := time.NewTimer(next)
+			select {
+			case <-f.ctx.Done():
+				timer.Stop()
+				return nil, f.ctx.Err()
+			case <-timer.C:
+			}
+			if err = op(); err != errRetriable {
+				if err != nil {
+					return nil, err
+				}
+				break
 			}
+		}
 	}
-	// Check if has operation failed after the retries
+	// Whether the loop above stopped because we ran out of retries or
+	// because the backoff policy gave up, f.err/f.res hold the outcome
+	// of the last attempt doReq actually made.
 	if f.err != nil {
 		return nil, f.err
 	}
-	return f.res, err
+	return f.res, nil
+}
+
+// UnexpectedStatusError is returned by Send (see ExpectStatus) when the
+// response status code isn't one of the expected ones. It's also what
+// Send returns when a retried request is still failing after its last
+// attempt (the Retry budget is spent or the backoff policy gave up).
+// The response body is captured here since the caller never gets a
+// chance to read it themselves.
+type UnexpectedStatusError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("fluent: unexpected status code %d: %s", e.StatusCode, e.Body)
+}
+
+// ExpectStatus turns any response whose status code isn't in codes into
+// an error (*UnexpectedStatusError), with the body captured for
+// diagnosis, instead of a normal response you have to check yourself.
+func (f *request) ExpectStatus(codes ...int) *request {
+	f.expectStatuses = codes
+	f.expectStatusIsSet = true
+	return f
+}
+
+func (f *request) checkExpectedStatus(res *http.Response) (*http.Response, error) {
+	if !f.expectStatusIsSet {
+		return res, nil
+	}
+	for _, code := range f.expectStatuses {
+		if res.StatusCode == code {
+			return res, nil
+		}
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	return nil, &UnexpectedStatusError{StatusCode: res.StatusCode, Body: body}
 }
 
 func (f *request) Send() (*http.Response, error) {
 	c := f.newClient()
 	res, err := f.do(c)
-	return res, err
+	if err != nil {
+		return res, err
+	}
+	return f.checkExpectedStatus(res)
+}
+
+// SendContext is a shorthand for Context(ctx).Send().
+func (f *request) SendContext(ctx context.Context) (*http.Response, error) {
+	return f.Context(ctx).Send()
+}
+
+// SendJSON sends the request and decodes the JSON response body into
+// out, closing the body for you.
+func (f *request) SendJSON(out interface{}) (*http.Response, error) {
+	res, err := f.Send()
+	if err != nil {
+		return res, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// SendString sends the request and reads the whole response body into a
+// string, closing it for you.
+func (f *request) SendString() (string, *http.Response, error) {
+	res, err := f.Send()
+	if err != nil {
+		return "", res, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", res, err
+	}
+	return string(body), res, nil
+}
+
+// SendBytes sends the request and reads the whole response body, closing
+// it for you.
+func (f *request) SendBytes() ([]byte, *http.Response, error) {
+	res, err := f.Send()
+	if err != nil {
+		return nil, res, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, res, err
+	}
+	return body, res, nil
 }
 
 func New() *request {
@@ -223,5 +790,6 @@ func New() *request {
 	f.header = map[string]string{}
 	f.backoff = backoff.NewExponentialBackOff()
 	f.err = nil
+	f.ctx = context.Background()
 	return f
 }
@@ -1,12 +1,17 @@
 package fluent
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -137,6 +142,456 @@ func TestJson(t *testing.T) {
 	}
 }
 
+func TestForm(t *testing.T) {
+	ts := httptest.NewServer(copyHandlerFunc)
+	defer ts.Close()
+
+	values := url.Values{}
+	values.Set("a", "1")
+	values.Set("b", "2")
+	res, err := New().Post(ts.URL).Form(values).Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := readAllString(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != values.Encode() {
+		t.Fatalf("Form body %q doesn't match %q", body, values.Encode())
+	}
+	if ct := res.Request.Header.Get("Content-type"); ct != "application/x-www-form-urlencoded" {
+		t.Fatalf("unexpected Content-type %q", ct)
+	}
+}
+
+func TestFormField(t *testing.T) {
+	ts := httptest.NewServer(copyHandlerFunc)
+	defer ts.Close()
+
+	res, err := New().Post(ts.URL).FormField("a", "1").FormField("b", "2").Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := readAllString(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := url.Values{"a": {"1"}, "b": {"2"}}.Encode()
+	if body != want {
+		t.Fatalf("Form body %q doesn't match %q", body, want)
+	}
+}
+
+// failOnceThenEchoHandler fails the first request with a 500, then
+// echoes the body on every subsequent request.
+func failOnceThenEchoHandler(t *testing.T) http.Handler {
+	var requests int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		body, err := readAllString(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		io.WriteString(w, body)
+	})
+}
+
+func TestBodyRetrySeekable(t *testing.T) {
+	ts := httptest.NewServer(failOnceThenEchoHandler(t))
+	defer ts.Close()
+
+	msg := "Hello world!"
+	// wrap in a type the stdlib doesn't already special-case for GetBody
+	body := struct {
+		io.ReadSeeker
+	}{strings.NewReader(msg)}
+
+	res, err := New().
+		Post(ts.URL).
+		Body(body).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := readAllString(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Fatalf("expected body %q after retry, got %q", msg, got)
+	}
+}
+
+func TestBodyRetryBuffered(t *testing.T) {
+	ts := httptest.NewServer(failOnceThenEchoHandler(t))
+	defer ts.Close()
+
+	msg := "Hello world!"
+	res, err := New().
+		Post(ts.URL).
+		Body(bufio.NewReader(strings.NewReader(msg))).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := readAllString(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != msg {
+		t.Fatalf("expected body %q after retry, got %q", msg, got)
+	}
+}
+
+// TestBodyOversizedDisablesRetry checks that a non-seekable Body bigger
+// than MaxBufferedBody never gets a silent, truncated retry: fluent
+// should give up on retrying rather than resend an emptied-out reader.
+func TestBodyOversizedDisablesRetry(t *testing.T) {
+	ts := httptest.NewServer(failOnceThenEchoHandler(t))
+	defer ts.Close()
+
+	msg := "Hello world!"
+	res, err := New().
+		Post(ts.URL).
+		Body(bufio.NewReader(strings.NewReader(msg))).
+		MaxBufferedBody(4).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 500 {
+		t.Fatalf("expected no retry to have happened, got status %d", res.StatusCode)
+	}
+}
+
+func TestJsonRetrySafe(t *testing.T) {
+	ts := httptest.NewServer(failOnceThenEchoHandler(t))
+	defer ts.Close()
+
+	res, err := New().
+		Post(ts.URL).
+		Json([]int{1, 2, 3}).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := readAllString(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "[1,2,3]" {
+		t.Fatalf("expected JSON body after retry, got %q", got)
+	}
+}
+
+func TestFormRetrySafe(t *testing.T) {
+	ts := httptest.NewServer(failOnceThenEchoHandler(t))
+	defer ts.Close()
+
+	values := url.Values{"a": {"1"}}
+	res, err := New().
+		Post(ts.URL).
+		Form(values).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	got, err := readAllString(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != values.Encode() {
+		t.Fatalf("expected form body after retry, got %q", got)
+	}
+}
+
+func TestSendJSON(t *testing.T) {
+	ts := httptest.NewServer(copyHandlerFunc)
+	defer ts.Close()
+
+	var out []int
+	_, err := New().Post(ts.URL).Json([]int{1, 2, 3}).SendJSON(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 3 || out[0] != 1 || out[1] != 2 || out[2] != 3 {
+		t.Fatalf("unexpected decoded JSON: %v", out)
+	}
+}
+
+func TestSendString(t *testing.T) {
+	ts := httptest.NewServer(copyHandlerFunc)
+	defer ts.Close()
+
+	msg := "Hello world!"
+	body, _, err := New().Post(ts.URL).Body(strings.NewReader(msg)).SendString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != msg {
+		t.Fatalf("expected %q, got %q", msg, body)
+	}
+}
+
+func TestSendBytes(t *testing.T) {
+	ts := httptest.NewServer(copyHandlerFunc)
+	defer ts.Close()
+
+	msg := "Hello world!"
+	body, _, err := New().Post(ts.URL).Body(strings.NewReader(msg)).SendBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != msg {
+		t.Fatalf("expected %q, got %q", msg, body)
+	}
+}
+
+func TestExpectStatus(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "not found")
+		}),
+	)
+	defer ts.Close()
+
+	_, err := New().Get(ts.URL).ExpectStatus(http.StatusOK).Send()
+	if err == nil {
+		t.Fatal("expected an error for unexpected status code")
+	}
+	statusErr, ok := err.(*UnexpectedStatusError)
+	if !ok {
+		t.Fatalf("expected *UnexpectedStatusError, got %T", err)
+	}
+	if statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, statusErr.StatusCode)
+	}
+	if string(statusErr.Body) != "not found" {
+		t.Fatalf("expected body %q, got %q", "not found", statusErr.Body)
+	}
+}
+
+func TestClientBaseURL(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, r.URL.Path)
+		}),
+	)
+	defer ts.Close()
+
+	c := &Client{BaseURL: ts.URL}
+	body, _, err := c.New().Get("/users").SendString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body != "/users" {
+		t.Fatalf("expected path %q, got %q", "/users", body)
+	}
+}
+
+func TestClientDefaultHeaders(t *testing.T) {
+	var gotAuth string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotAuth = r.Header.Get("Authorization")
+		}),
+	)
+	defer ts.Close()
+
+	c := &Client{
+		BaseURL:        ts.URL,
+		DefaultHeaders: map[string]string{"Authorization": "Bearer token"},
+	}
+	if _, err := c.New().Get("/").Send(); err != nil {
+		t.Fatal(err)
+	}
+	if gotAuth != "Bearer token" {
+		t.Fatalf("expected default Authorization header, got %q", gotAuth)
+	}
+}
+
+func TestClientSharesHTTPClient(t *testing.T) {
+	ts := httptest.NewServer(copyHandlerFunc)
+	defer ts.Close()
+
+	httpClient := &http.Client{}
+	c := &Client{BaseURL: ts.URL, HTTPClient: httpClient}
+	req := c.New().Get("/")
+	if req.newClient() != httpClient {
+		t.Fatal("expected the request to reuse the Client's *http.Client")
+	}
+}
+
+func TestTransport(t *testing.T) {
+	rt := &countingTransport{}
+	res, err := New().Get("http://example.invalid").Transport(rt).Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusTeapot {
+		t.Fatalf("expected the custom transport's response to be used, got %d", res.StatusCode)
+	}
+	if rt.calls != 1 {
+		t.Fatalf("expected the custom transport to be used exactly once, got %d", rt.calls)
+	}
+}
+
+type countingTransport struct {
+	calls int
+}
+
+func (t *countingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	t.calls++
+	return &http.Response{
+		StatusCode: http.StatusTeapot,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Header:     http.Header{},
+	}, nil
+}
+
+func TestMultipart(t *testing.T) {
+	var gotField, gotFileName, gotFileContents string
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatal(err)
+			}
+			gotField = r.FormValue("desc")
+			file, header, err := r.FormFile("file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			gotFileName = header.Filename
+			body, err := readAllString(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFileContents = body
+		}),
+	)
+	defer ts.Close()
+
+	res, err := New().
+		Post(ts.URL).
+		MultipartFile("file", "a.png", strings.NewReader("binary data")).
+		MultipartField("desc", "hi").
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if gotField != "hi" {
+		t.Fatalf("expected field %q, got %q", "hi", gotField)
+	}
+	if gotFileName != "a.png" {
+		t.Fatalf("expected file name %q, got %q", "a.png", gotFileName)
+	}
+	if gotFileContents != "binary data" {
+		t.Fatalf("expected file contents %q, got %q", "binary data", gotFileContents)
+	}
+}
+
+func TestMultipartFileRetryBuffered(t *testing.T) {
+	var gotFileContents string
+	attempts := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			attempts++
+			if attempts == 1 {
+				w.WriteHeader(500)
+				return
+			}
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				t.Fatal(err)
+			}
+			file, _, err := r.FormFile("file")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			body, err := readAllString(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFileContents = body
+		}),
+	)
+	defer ts.Close()
+
+	res, err := New().
+		Post(ts.URL).
+		MultipartFile("file", "a.png", strings.NewReader("binary data")).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	if gotFileContents != "binary data" {
+		t.Fatalf("expected file contents %q to survive the retry, got %q", "binary data", gotFileContents)
+	}
+}
+
+// TestMultipartFileOversizedDisablesRetry checks that a MultipartFile
+// part bigger than MaxBufferedBody never gets a silent, truncated
+// retry: fluent should give up on retrying rather than resend the part
+// empty.
+func TestMultipartFileOversizedDisablesRetry(t *testing.T) {
+	ts := httptest.NewServer(failOnceThenEchoHandler(t))
+	defer ts.Close()
+
+	res, err := New().
+		Post(ts.URL).
+		MultipartFile("file", "a.png", strings.NewReader("binary data")).
+		MaxBufferedBody(4).
+		InitialInterval(time.Millisecond).
+		RetryUnsafe(true).
+		Retry(1).
+		Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 500 {
+		t.Fatalf("expected no retry to have happened, got status %d", res.StatusCode)
+	}
+}
+
 func TestRetries(t *testing.T) {
 	retry := 3
 	ts := httptest.NewServer(
@@ -150,6 +605,7 @@ func TestRetries(t *testing.T) {
 	req.Post(ts.URL).
 		InitialInterval(time.Millisecond).
 		Json([]int{1, 3, 4}).
+		RetryUnsafe(true).
 		Retry(retry)
 	if req.retry != retry {
 		t.Fatalf("Retries didn't apply!")
@@ -184,6 +640,175 @@ func TestTimeout(t *testing.T) {
 	}
 }
 
+func TestContextCancellation(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+		}),
+	)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	req := New()
+	_, err := req.Post(ts.URL).
+		InitialInterval(100*time.Millisecond).
+		RetryUnsafe(true).
+		Retry(3).
+		SendContext(ctx)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestRetryNonIdempotentSkipped(t *testing.T) {
+	attempts := 0
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(500)
+		}),
+	)
+	defer ts.Close()
+
+	req := New()
+	req.Post(ts.URL).InitialInterval(time.Millisecond).Retry(3)
+	if _, err := req.Send(); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 {
+		t.Fatalf("expected POST not to be retried by default, got %d attempts", attempts)
+	}
+	if req.retry != 3 {
+		t.Fatalf("retry budget should be untouched, got %d", req.retry)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	attempts := 0
+	start := time.Now()
+	var elapsed time.Duration
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if attempts == 1 {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			elapsed = time.Since(start)
+			w.WriteHeader(http.StatusOK)
+		}),
+	)
+	defer ts.Close()
+
+	req := New()
+	// a huge InitialInterval makes it obvious whether Retry-After (1s)
+	// or the exponential backoff interval was honored
+	_, err := req.Get(ts.URL).InitialInterval(time.Hour).Retry(1).Send()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed < time.Second {
+		t.Fatalf("Retry-After wasn't honored, retried after only %s", elapsed)
+	}
+}
+
+func TestMaxElapsedTimeSurfacesLastResponse(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+			io.WriteString(w, "server is down")
+		}),
+	)
+	defer ts.Close()
+
+	req := New()
+	_, err := req.Get(ts.URL).
+		InitialInterval(10*time.Millisecond).
+		MaxElapsedTime(30*time.Millisecond).
+		// a retry budget far larger than MaxElapsedTime lets us hit,
+		// so backoff gives up before the retry count does
+		Retry(1000).
+		Send()
+	if err == nil {
+		t.Fatal("expected an error once the backoff policy gave up")
+	}
+	statusErr, ok := err.(*UnexpectedStatusError)
+	if !ok {
+		t.Fatalf("expected *UnexpectedStatusError describing the last response, got %T: %v", err, err)
+	}
+	if statusErr.StatusCode != 500 {
+		t.Fatalf("expected status 500, got %d", statusErr.StatusCode)
+	}
+	if string(statusErr.Body) != "server is down" {
+		t.Fatalf("expected the last response body, got %q", statusErr.Body)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}),
+	)
+	defer ts.Close()
+
+	req := New()
+	req.Get(ts.URL).
+		InitialInterval(time.Millisecond).
+		RetryPolicy(func(res *http.Response, err error) bool {
+			return res != nil && res.StatusCode == http.StatusNotFound
+		}).
+		Retry(2)
+	_, err := req.Send()
+	if req.retry != 0 {
+		t.Fatalf("custom RetryPolicy should have triggered retries, retry left %d", req.retry)
+	}
+	// the server never stops 404ing, so once the retry budget runs out
+	// the last failing response should be surfaced, not swallowed.
+	statusErr, ok := err.(*UnexpectedStatusError)
+	if !ok {
+		t.Fatalf("expected *UnexpectedStatusError once retries are exhausted, got %v", err)
+	}
+	if statusErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d", http.StatusNotFound, statusErr.StatusCode)
+	}
+}
+
+// TestRetryBudgetExhaustedSurfacesLastResponse checks that running out
+// of the Retry(n) budget against a still-failing response behaves the
+// same way as MaxElapsedTime giving up: the last response is surfaced
+// as an error instead of being returned as if it had succeeded.
+func TestRetryBudgetExhaustedSurfacesLastResponse(t *testing.T) {
+	ts := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(500)
+			io.WriteString(w, "server is down")
+		}),
+	)
+	defer ts.Close()
+
+	_, err := New().Get(ts.URL).
+		InitialInterval(time.Millisecond).
+		Retry(1).
+		Send()
+	if err == nil {
+		t.Fatal("expected an error once the retry budget ran out")
+	}
+	statusErr, ok := err.(*UnexpectedStatusError)
+	if !ok {
+		t.Fatalf("expected *UnexpectedStatusError describing the last response, got %T: %v", err, err)
+	}
+	if statusErr.StatusCode != 500 {
+		t.Fatalf("expected status 500, got %d", statusErr.StatusCode)
+	}
+	if string(statusErr.Body) != "server is down" {
+		t.Fatalf("expected the last response body, got %q", statusErr.Body)
+	}
+}
+
 func TestRandomizationFactor(t *testing.T) {
 	req := New()
 	req.RandomizationFactor(0.6)